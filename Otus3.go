@@ -1,18 +1,19 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/nitrodenov/otus/controllers"
+	"github.com/nitrodenov/otus/pkg/auth"
+	"github.com/nitrodenov/otus/pkg/db"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
-	"time"
+	"strings"
 )
 
 type User struct {
@@ -24,18 +25,55 @@ type User struct {
 	Phone     string `json:"phone"`
 }
 
-type Error struct {
-	code    int32
-	message string
+// dbRevocationChecker checks the revoked_tokens table the auth service
+// writes to on logout, so this service can validate JWTs against revocation
+// without calling back into the auth service.
+type dbRevocationChecker struct {
+	db *sql.DB
+}
+
+func (c dbRevocationChecker) IsRevoked(jti string) (bool, error) {
+	var revoked bool
+	err := c.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti=$1)`, jti).Scan(&revoked)
+	return revoked, err
 }
 
 func main() {
-	initMetrics()
+	pool, err := db.Open()
+	if err != nil {
+		log.Fatalf("Unable to open the database pool. %v", err)
+	}
+
+	if _, err := auth.JWTSecret(); err != nil {
+		log.Fatalf("Unable to load the JWT signing secret. %v", err)
+	}
+
+	revoked := dbRevocationChecker{db: pool}
+
 	r := mux.NewRouter()
-	r.HandleFunc("/user", addUser).Methods("POST")
-	r.HandleFunc("/user/{id}", getUser).Methods("GET")
-	r.HandleFunc("/user/{id}", updateUser).Methods("PUT")
-	r.HandleFunc("/user/{id}", deleteUser).Methods("DELETE")
+	r.Handle("/user", auth.JWTMiddleware(revoked, "admin")(&controllers.JSONHandler{
+		Route:   "add_user",
+		Methods: []string{"POST"},
+		Process: addUser,
+		DB:      pool,
+	})).Methods("POST")
+	r.Handle("/user/{id}", auth.JWTMiddleware(revoked)(&controllers.JSONHandler{
+		Route:   "get_user",
+		Process: getUser,
+		DB:      pool,
+	})).Methods("GET")
+	r.Handle("/user/{id}", auth.JWTMiddleware(revoked, "admin")(&controllers.JSONHandler{
+		Route:   "update_user",
+		Methods: []string{"PUT"},
+		Process: updateUser,
+		DB:      pool,
+	})).Methods("PUT")
+	r.Handle("/user/{id}", auth.JWTMiddleware(revoked, "admin")(&controllers.JSONHandler{
+		Route:   "delete_user",
+		Methods: []string{"DELETE"},
+		Process: deleteUser,
+		DB:      pool,
+	})).Methods("DELETE")
 	r.PathPrefix("/metrics").Handler(promhttp.Handler())
 	http.Handle("/", r)
 
@@ -43,262 +81,165 @@ func main() {
 	http.ListenAndServe(":8000", nil)
 }
 
-func initMetrics() {
-	prometheus.MustRegister(RequestCountAdd)
-	prometheus.MustRegister(RequestCountGet)
-	prometheus.MustRegister(RequestCountPut)
-	prometheus.MustRegister(RequestCountDelete)
-
-	prometheus.MustRegister(ErrorAdd)
-	prometheus.MustRegister(ErrorGet)
-	prometheus.MustRegister(ErrorPut)
-	prometheus.MustRegister(ErrorDelete)
-
-	prometheus.MustRegister(LatencyAdd)
-	prometheus.MustRegister(LatencyGet)
-	prometheus.MustRegister(LatencyPut)
-	prometheus.MustRegister(LatencyDelete)
+func badId() (controllers.JSONResult, error) {
+	return controllers.JSONResult{
+		StatusCode: http.StatusBadRequest,
+		Body:       map[string]string{"message": "Unable to convert the string into int."},
+	}, nil
 }
 
-func addUser(writer http.ResponseWriter, request *http.Request) {
-	requestStart := time.Now()
-
-	writer.Header().Set("Context-Type", "application/x-www-form-urlencoded")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("Access-Control-Allow-Methods", "POST")
-	writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
+func addUser(writer http.ResponseWriter, request *http.Request, input interface{}, conn *sql.DB) (controllers.JSONResult, error) {
 	var user User
-
-	err := json.NewDecoder(request.Body).Decode(&user)
-
-	if err != nil {
-		error := Error{
-			code:    0,
-			message: "Unable to decode the request body. ",
-		}
-		json.NewEncoder(writer).Encode(error)
-		ErrorAdd.Inc()
-		return
+	if _, err := controllers.DecodeStrict(request, &user, "id"); err != nil {
+		return controllers.JSONResult{}, err
 	}
 
-	_ = insertUser(user)
-
-	writer.WriteHeader(200)
-
-	RequestCountAdd.Inc()
-	requestTime := time.Since(requestStart).Seconds()
-	log.Printf("requestTime %s", requestTime)
-	LatencyAdd.Observe(requestTime)
+	if _, err := insertUser(request.Context(), conn, user); err != nil {
+		return controllers.JSONResult{}, err
+	}
+	return controllers.JSONResult{StatusCode: http.StatusOK}, nil
 }
 
-func getUser(writer http.ResponseWriter, request *http.Request) {
-	requestStart := time.Now()
-
-	writer.Header().Set("Context-Type", "application/x-www-form-urlencoded")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
-
+func getUser(writer http.ResponseWriter, request *http.Request, input interface{}, conn *sql.DB) (controllers.JSONResult, error) {
 	params := mux.Vars(request)
 	id, err := strconv.Atoi(params["id"])
 	if err != nil {
-		error := Error{
-			code:    0,
-			message: "Unable to convert the string into int.",
-		}
-		json.NewEncoder(writer).Encode(error)
-		ErrorGet.Inc()
-		return
+		return badId()
 	}
 
-	user, err := getUserFromDB(int64(id))
-
+	user, err := getUserFromDB(request.Context(), conn, int64(id))
 	if err != nil {
-		error := Error{
-			code:    0,
-			message: "Unable to get user.",
-		}
-		json.NewEncoder(writer).Encode(error)
-		ErrorGet.Inc()
-		return
+		return controllers.JSONResult{}, err
 	}
 
-	writer.WriteHeader(200)
-	json.NewEncoder(writer).Encode(user)
-
-	RequestCountGet.Inc()
-	requestTime := time.Since(requestStart).Seconds()
-	log.Printf("requestTime %s", requestTime)
-	LatencyGet.Observe(requestTime)
+	return controllers.JSONResult{StatusCode: http.StatusOK, Body: user}, nil
 }
 
-func updateUser(writer http.ResponseWriter, request *http.Request) {
-	requestStart := time.Now()
-
-	writer.Header().Set("Content-Type", "application/x-www-form-urlencoded")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("Access-Control-Allow-Methods", "PUT")
-	writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
+func updateUser(writer http.ResponseWriter, request *http.Request, input interface{}, conn *sql.DB) (controllers.JSONResult, error) {
 	params := mux.Vars(request)
 	id, err := strconv.Atoi(params["id"])
 	if err != nil {
-		error := Error{
-			code:    0,
-			message: "Unable to convert the string into int.",
-		}
-		json.NewEncoder(writer).Encode(error)
-		ErrorPut.Inc()
-		return
+		return badId()
 	}
 
 	var user User
-
-	err = json.NewDecoder(request.Body).Decode(&user)
-
+	present, err := controllers.DecodeStrict(request, &user, "id", "username", "firstName", "lastName", "email", "phone")
 	if err != nil {
-		error := Error{
-			code:    0,
-			message: "Unable to decode the request body.",
-		}
-		json.NewEncoder(writer).Encode(error)
-		ErrorPut.Inc()
-		return
+		return controllers.JSONResult{}, err
 	}
 
-	_ = updateUserInDB(int64(id), user)
-
-	writer.WriteHeader(200)
+	if _, err := updateUserInDB(request.Context(), conn, int64(id), user, present); err != nil {
+		return controllers.JSONResult{}, err
+	}
 
-	RequestCountPut.Inc()
-	requestTime := time.Since(requestStart).Seconds()
-	log.Printf("requestTime %s", requestTime)
-	LatencyPut.Observe(requestTime)
+	return controllers.JSONResult{StatusCode: http.StatusOK}, nil
 }
 
-func deleteUser(writer http.ResponseWriter, request *http.Request) {
-	requestStart := time.Now()
-
-	writer.Header().Set("Context-Type", "application/x-www-form-urlencoded")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("Access-Control-Allow-Methods", "DELETE")
-	writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
+func deleteUser(writer http.ResponseWriter, request *http.Request, input interface{}, conn *sql.DB) (controllers.JSONResult, error) {
 	params := mux.Vars(request)
 	id, err := strconv.Atoi(params["id"])
 	if err != nil {
-		error := Error{
-			code:    0,
-			message: "Unable to convert the string into int.",
-		}
-		json.NewEncoder(writer).Encode(error)
-		ErrorDelete.Inc()
-		return
+		return badId()
 	}
 
-	_ = deleteUserFromDB(int64(id))
-
-	writer.WriteHeader(204)
+	if _, err := deleteUserFromDB(request.Context(), conn, int64(id)); err != nil {
+		return controllers.JSONResult{}, err
+	}
 
-	RequestCountDelete.Inc()
-	requestTime := time.Since(requestStart).Seconds()
-	log.Printf("requestTime %s", requestTime)
-	LatencyDelete.Observe(requestTime)
+	return controllers.JSONResult{StatusCode: http.StatusNoContent}, nil
 }
 
-func insertUser(user User) int64 {
-	db := createConnection()
-	defer db.Close()
-
+func insertUser(ctx context.Context, conn *sql.DB, user User) (int64, error) {
 	sqlStatement := `INSERT INTO users (username, firstName, lastName, email, phone) VALUES ($1, $2, $3, $4, $5) RETURNING Id`
 
 	var id int64
-
-	err := db.QueryRow(sqlStatement, user.Username, user.FirstName, user.LastName, user.Email, user.Phone).Scan(&id)
-	if err != nil {
-		log.Fatalf("Unable to execute the query. %v", err)
+	if err := conn.QueryRowContext(ctx, sqlStatement, user.Username, user.FirstName, user.LastName, user.Email, user.Phone).Scan(&id); err != nil {
+		return 0, err
 	}
 
 	fmt.Printf("Inserted a single record %v", id)
-	return id
+	return id, nil
 }
 
-func getUserFromDB(id int64) (User, error) {
-	db := createConnection()
-	defer db.Close()
-
+func getUserFromDB(ctx context.Context, conn *sql.DB, id int64) (User, error) {
 	var user User
 
 	sqlStatement := `SELECT * FROM users WHERE id=$1`
-
-	row := db.QueryRow(sqlStatement, id)
-
+	row := conn.QueryRowContext(ctx, sqlStatement, id)
 	err := row.Scan(&user.Id, &user.Username, &user.FirstName, &user.LastName, &user.Email, &user.Phone)
 
-	switch err {
-	case sql.ErrNoRows:
-		fmt.Println("No rows were returned!")
-		return user, nil
-	case nil:
-		return user, nil
-	default:
-		log.Fatalf("Unable to scan the row. %v", err)
-	}
-
 	return user, err
 }
 
-func updateUserInDB(id int64, user User) int64 {
-	db := createConnection()
-	defer db.Close()
+// userColumns maps the updatable User fields to their column names, in a
+// fixed order so the SQL updateUserInDB builds is deterministic.
+var userColumns = []string{"username", "firstName", "lastName", "email", "phone"}
+
+func columnValue(user User, column string) interface{} {
+	switch column {
+	case "username":
+		return user.Username
+	case "firstName":
+		return user.FirstName
+	case "lastName":
+		return user.LastName
+	case "email":
+		return user.Email
+	case "phone":
+		return user.Phone
+	default:
+		return nil
+	}
+}
 
-	sqlStatement := `UPDATE users SET username=$2, firstName=$3, lastName=$4, email=$5, phone=$6 WHERE id=$1`
+// updateUserInDB only touches the columns present reports as present in the
+// request body, so omitted fields keep their existing value instead of
+// being blanked out.
+func updateUserInDB(ctx context.Context, conn *sql.DB, id int64, user User, present map[string]bool) (int64, error) {
+	var sets []string
+	args := []interface{}{id}
 
-	res, err := db.Exec(sqlStatement, id, user.Username, user.FirstName, user.LastName, user.Email, &user.Phone)
-	if err != nil {
-		log.Fatalf("Unable to execute the query. %v", err)
+	for _, column := range userColumns {
+		if !present[column] {
+			continue
+		}
+		args = append(args, columnValue(user, column))
+		sets = append(sets, fmt.Sprintf("%s=$%d", column, len(args)))
 	}
 
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		log.Fatalf("Error while checking the affected rows. %v", err)
+	if len(sets) == 0 {
+		return 0, nil
 	}
 
-	fmt.Printf("Total rows/record affected %v", rowsAffected)
-	return rowsAffected
-}
+	sqlStatement := fmt.Sprintf("UPDATE users SET %s WHERE id=$1", strings.Join(sets, ", "))
 
-func deleteUserFromDB(id int64) int64 {
-	db := createConnection()
-	defer db.Close()
-
-	sqlStatement := `DELETE FROM users WHERE id=$1`
-
-	res, err := db.Exec(sqlStatement, id)
+	res, err := conn.ExecContext(ctx, sqlStatement, args...)
 	if err != nil {
-		log.Fatalf("Unable to execute the query. %v", err)
+		return 0, err
 	}
 
 	rowsAffected, err := res.RowsAffected()
 	if err != nil {
-		log.Fatalf("Error while checking the affected rows. %v", err)
+		return 0, err
 	}
 
 	fmt.Printf("Total rows/record affected %v", rowsAffected)
-	return rowsAffected
+	return rowsAffected, nil
 }
 
-func createConnection() *sql.DB {
-	psqlconn := os.Getenv("DATABASE_URI")
-	db, err := sql.Open("postgres", psqlconn)
+func deleteUserFromDB(ctx context.Context, conn *sql.DB, id int64) (int64, error) {
+	sqlStatement := `DELETE FROM users WHERE id=$1`
+
+	res, err := conn.ExecContext(ctx, sqlStatement, id)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
-	err = db.Ping()
+	rowsAffected, err := res.RowsAffected()
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
-	fmt.Println("Successfully connected!")
-	return db
+	fmt.Printf("Total rows/record affected %v", rowsAffected)
+	return rowsAffected, nil
 }
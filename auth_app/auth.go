@@ -1,17 +1,46 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"github.com/nitrodenov/otus/controllers"
+	sessionauth "github.com/nitrodenov/otus/pkg/auth"
+	"github.com/nitrodenov/otus/pkg/db"
+	"golang.org/x/crypto/scrypt"
+	"log"
+	"math/big"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
+const (
+	scryptPrefix = "scrypt"
+	scryptN      = 32768
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 64
+	saltAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	saltLength   = 16
+
+	sessionTTL          = 30 * time.Minute
+	sessionSnapshotPath = "sessions.snapshot"
+
+	defaultAccessTokenTTL = time.Hour
+)
+
 type User struct {
 	Id        string `json:"id"`
 	Login     string `json:"login"`
@@ -19,14 +48,83 @@ type User struct {
 	Email     string `json:"email"`
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
+	Role      string `json:"role"`
 }
 
-var sessions = make(map[string]User)
+// defaultRole is assigned to new users that don't specify one on register.
+const defaultRole = "user"
+
+// AuthResponse is returned by login and refresh: the user plus the token
+// pair the client should use going forward.
+type AuthResponse struct {
+	User
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// RefreshRequest is the body expected by POST /refresh.
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+func accessTokenTTL() time.Duration {
+	if minutes, err := strconv.Atoi(os.Getenv("JWT_TTL_MINUTES")); err == nil && minutes > 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return defaultAccessTokenTTL
+}
+
+// Sessions is the process-wide session store, set up in main.
+var Sessions *sessionauth.SessionStore
+
+// pool is the process-wide DB connection pool, set up in main. Handlers
+// registered through JSONHandler get it via their db parameter instead.
+var pool *sql.DB
 
 func main() {
+	var err error
+	pool, err = db.Open()
+	if err != nil {
+		log.Fatalf("Unable to open the database pool. %v", err)
+	}
+
+	if _, err := sessionauth.JWTSecret(); err != nil {
+		log.Fatalf("Unable to load the JWT signing secret. %v", err)
+	}
+
+	Sessions = sessionauth.NewSessionStore(sessionTTL)
+	loadSessionSnapshot()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		saveSessionSnapshot()
+		os.Exit(0)
+	}()
+
 	r := mux.NewRouter()
-	r.HandleFunc("/register", register).Methods("POST")
-	r.HandleFunc("/login", login).Methods("POST")
+	r.Handle("/register", &controllers.JSONHandler{
+		Route:   "register",
+		Methods: []string{"POST"},
+		Input:   func() interface{} { return &User{} },
+		Process: register,
+		DB:      pool,
+	}).Methods("POST")
+	r.Handle("/login", &controllers.JSONHandler{
+		Route:   "login",
+		Methods: []string{"POST"},
+		Input:   func() interface{} { return &User{} },
+		Process: login,
+		DB:      pool,
+	}).Methods("POST")
+	r.Handle("/refresh", &controllers.JSONHandler{
+		Route:   "refresh",
+		Methods: []string{"POST"},
+		Input:   func() interface{} { return &RefreshRequest{} },
+		Process: refresh,
+		DB:      pool,
+	}).Methods("POST")
 	r.HandleFunc("/signin", signin).Methods("GET")
 	r.HandleFunc("/auth", auth).Methods("GET")
 	r.HandleFunc("/logout", logout).Methods("GET")
@@ -36,53 +134,152 @@ func main() {
 	http.ListenAndServe(":8000", nil)
 }
 
-func register(writer http.ResponseWriter, request *http.Request) {
-	defer request.Body.Close()
-
-	writer.Header().Set("Context-Type", "application/x-www-form-urlencoded")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("Access-Control-Allow-Methods", "POST")
-	writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+func loadSessionSnapshot() {
+	file, err := os.Open(sessionSnapshotPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
 
-	var user User
+	if err := Sessions.Load(file); err != nil {
+		fmt.Printf("Error loading session snapshot. %v\n", err)
+	}
+}
 
-	err := json.NewDecoder(request.Body).Decode(&user)
+func saveSessionSnapshot() {
+	file, err := os.Create(sessionSnapshotPath)
 	if err != nil {
-		fmt.Println("Error in register")
+		fmt.Printf("Error creating session snapshot file. %v\n", err)
+		return
 	}
+	defer file.Close()
 
-	insertUser(user)
-	writer.WriteHeader(200)
+	if err := Sessions.Snapshot(file); err != nil {
+		fmt.Printf("Error saving session snapshot. %v\n", err)
+	}
 }
 
-func login(writer http.ResponseWriter, request *http.Request) {
-	defer request.Body.Close()
+func toAuthUser(user User) sessionauth.User {
+	return sessionauth.User{
+		Id:        user.Id,
+		Login:     user.Login,
+		Password:  user.Password,
+		Email:     user.Email,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Role:      user.Role,
+	}
+}
 
-	writer.Header().Set("Context-Type", "application/x-www-form-urlencoded")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
-	writer.Header().Set("Access-Control-Allow-Methods", "POST")
-	writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+func register(writer http.ResponseWriter, request *http.Request, input interface{}, conn *sql.DB) (controllers.JSONResult, error) {
+	user := input.(*User)
+	ctx := request.Context()
 
-	var user User
+	salt, err := generateSalt()
+	if err != nil {
+		return controllers.JSONResult{}, err
+	}
 
-	err := json.NewDecoder(request.Body).Decode(&user)
+	hashed, err := hashPassword(user.Password, salt)
 	if err != nil {
-		fmt.Println("Error in login")
+		return controllers.JSONResult{}, err
+	}
+	user.Password = hashed
+
+	// Role is never client-settable: registering always grants defaultRole,
+	// regardless of what the request body contains. This service has no
+	// route that changes a user's role afterwards.
+	user.Role = defaultRole
+
+	if _, err := insertUser(ctx, conn, *user); err != nil {
+		return controllers.JSONResult{}, err
 	}
+	return controllers.JSONResult{StatusCode: http.StatusOK}, nil
+}
 
-	userInfo, err := getUserInfo(user.Login, user.Password)
+func login(writer http.ResponseWriter, request *http.Request, input interface{}, conn *sql.DB) (controllers.JSONResult, error) {
+	user := input.(*User)
+	ctx := request.Context()
+
+	userInfo, err := getUserInfo(ctx, conn, user.Login)
 	if err != nil {
-		fmt.Println("Error in login after getting user info")
+		// Unknown login must look exactly like a wrong password: a
+		// distinct status code here (e.g. the generic DB-error mapper's
+		// 404) would let an attacker enumerate registered logins.
+		return controllers.JSONResult{StatusCode: http.StatusUnauthorized}, nil
+	}
+
+	match, err := verifyPassword(user.Password, userInfo.Password)
+	if err != nil || !match {
+		return controllers.JSONResult{StatusCode: http.StatusUnauthorized}, nil
+	}
+
+	if isLegacyPassword(userInfo.Password) {
+		salt, err := generateSalt()
+		if err == nil {
+			if hashed, err := hashPassword(user.Password, salt); err == nil {
+				if err := rehashPassword(ctx, conn, userInfo.Login, hashed); err != nil {
+					fmt.Println("Error rehashing legacy password")
+				} else {
+					userInfo.Password = hashed
+				}
+			}
+		}
 	}
 
-	sessionId := createSession(user)
+	sessionId := createSession(userInfo)
 	http.SetCookie(writer, &http.Cookie{
 		Name:     "session_id",
 		Value:    sessionId,
 		HttpOnly: true,
 	})
-	writer.WriteHeader(200)
-	json.NewEncoder(writer).Encode(userInfo)
+
+	accessToken, err := sessionauth.IssueToken(toAuthUser(userInfo), accessTokenTTL())
+	if err != nil {
+		return controllers.JSONResult{}, err
+	}
+
+	refreshToken, err := issueRefreshToken(ctx, conn, userInfo.Id)
+	if err != nil {
+		return controllers.JSONResult{}, err
+	}
+
+	return controllers.JSONResult{StatusCode: http.StatusOK, Body: AuthResponse{
+		User:         userInfo,
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}}, nil
+}
+
+func refresh(writer http.ResponseWriter, request *http.Request, input interface{}, conn *sql.DB) (controllers.JSONResult, error) {
+	req := input.(*RefreshRequest)
+	ctx := request.Context()
+
+	userId, err := rotateRefreshToken(ctx, conn, req.RefreshToken)
+	if err != nil {
+		return controllers.JSONResult{StatusCode: http.StatusUnauthorized}, nil
+	}
+
+	userInfo, err := getUserById(ctx, conn, userId)
+	if err != nil {
+		return controllers.JSONResult{}, err
+	}
+
+	accessToken, err := sessionauth.IssueToken(toAuthUser(userInfo), accessTokenTTL())
+	if err != nil {
+		return controllers.JSONResult{}, err
+	}
+
+	newRefreshToken, err := issueRefreshToken(ctx, conn, userInfo.Id)
+	if err != nil {
+		return controllers.JSONResult{}, err
+	}
+
+	return controllers.JSONResult{StatusCode: http.StatusOK, Body: AuthResponse{
+		User:         userInfo,
+		AccessToken:  accessToken,
+		RefreshToken: newRefreshToken,
+	}}, nil
 }
 
 func signin(writer http.ResponseWriter, request *http.Request) {
@@ -96,15 +293,32 @@ func auth(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(401)
 		return
 	}
-	user := sessions[cookie.Value]
+	user, ok := Sessions.Lookup(cookie.Value)
+	if !ok {
+		writer.WriteHeader(401)
+		return
+	}
 	writer.Header().Add("X-UserId", user.Id)
 	writer.Header().Add("X-User", user.Login)
 	writer.Header().Add("X-Email", user.Email)
 	writer.Header().Add("X-First-Name", user.FirstName)
 	writer.Header().Add("X-Last-Name", user.LastName)
+	writer.Header().Add("X-Role", user.Role)
 }
 
 func logout(writer http.ResponseWriter, request *http.Request) {
+	if cookie, err := request.Cookie("session_id"); err == nil {
+		Sessions.Delete(cookie.Value)
+	}
+
+	if tokenString := bearerToken(request); tokenString != "" {
+		if claims, err := sessionauth.ParseToken(tokenString); err == nil {
+			if err := revokeJTI(request.Context(), pool, claims.ID); err != nil {
+				fmt.Printf("Error revoking token. %v\n", err)
+			}
+		}
+	}
+
 	http.SetCookie(writer, &http.Cookie{
 		Name:    "session_id",
 		Value:   "",
@@ -112,65 +326,167 @@ func logout(writer http.ResponseWriter, request *http.Request) {
 	})
 }
 
-func getUserInfo(login string, password string) (User, error) {
-	db := createConnection()
-	defer db.Close()
+func bearerToken(request *http.Request) string {
+	header := request.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(header, "Bearer ")
+}
 
+func getUserInfo(ctx context.Context, conn *sql.DB, login string) (User, error) {
 	var user User
 
-	sqlStatement := `SELECT * FROM users WHERE login=$1 AND password=$2`
-	row := db.QueryRow(sqlStatement, login, password)
-	err := row.Scan(&user.Id, &user.Login, &user.Password, &user.Email, &user.FirstName, &user.LastName)
+	sqlStatement := `SELECT * FROM users WHERE login=$1`
+	row := conn.QueryRowContext(ctx, sqlStatement, login)
+	err := row.Scan(&user.Id, &user.Login, &user.Password, &user.Email, &user.FirstName, &user.LastName, &user.Role)
 
-	switch err {
-	case sql.ErrNoRows:
-		fmt.Println("No rows were returned!")
-		return user, nil
-	case nil:
-		return user, nil
-	default:
-		fmt.Println("Unable to scan the row. %v", err)
-	}
+	return user, err
+}
+
+func getUserById(ctx context.Context, conn *sql.DB, id string) (User, error) {
+	var user User
+
+	sqlStatement := `SELECT * FROM users WHERE id=$1`
+	row := conn.QueryRowContext(ctx, sqlStatement, id)
+	err := row.Scan(&user.Id, &user.Login, &user.Password, &user.Email, &user.FirstName, &user.LastName, &user.Role)
 
 	return user, err
 }
 
-func insertUser(user User) string {
-	db := createConnection()
-	defer db.Close()
+// issueRefreshToken stores a fresh, unrevoked refresh token for userId.
+func issueRefreshToken(ctx context.Context, conn *sql.DB, userId string) (string, error) {
+	token := uuid.New().String()
+	sqlStatement := `INSERT INTO refresh_tokens (token, user_id, created_at, revoked) VALUES ($1, $2, now(), false)`
+	if _, err := conn.ExecContext(ctx, sqlStatement, token, userId); err != nil {
+		return "", err
+	}
+	return token, nil
+}
 
-	userId := uuid.New().String()
-	sqlStatement := `INSERT INTO users (id, login, password, email, firstName, lastName) VALUES ($1, $2, $3, $4, $5, $6) RETURNING Id`
+// rotateRefreshToken revokes token, failing if it is unknown or already
+// revoked, and returns the user ID it belongs to. It does not issue the
+// replacement token; the caller does that with issueRefreshToken.
+func rotateRefreshToken(ctx context.Context, conn *sql.DB, token string) (string, error) {
+	var userId string
+	var revoked bool
+	row := conn.QueryRowContext(ctx, `SELECT user_id, revoked FROM refresh_tokens WHERE token=$1`, token)
+	if err := row.Scan(&userId, &revoked); err != nil {
+		return "", err
+	}
+	if revoked {
+		return "", fmt.Errorf("refresh token has been revoked")
+	}
 
-	var id string
+	if _, err := conn.ExecContext(ctx, `UPDATE refresh_tokens SET revoked=true WHERE token=$1`, token); err != nil {
+		return "", err
+	}
 
-	err := db.QueryRow(sqlStatement, userId, user.Login, user.Password, user.Email, user.FirstName, user.LastName).Scan(&id)
-	if err != nil {
-		fmt.Println("Unable to execute the query. %v", err)
+	return userId, nil
+}
+
+// revokeJTI records a JWT ID as revoked so JWTMiddleware rejects it even
+// before it expires.
+func revokeJTI(ctx context.Context, conn *sql.DB, jti string) error {
+	_, err := conn.ExecContext(ctx, `INSERT INTO revoked_tokens (jti, revoked_at) VALUES ($1, now())`, jti)
+	return err
+}
+
+func rehashPassword(ctx context.Context, conn *sql.DB, login string, hashed string) error {
+	sqlStatement := `UPDATE users SET password=$2 WHERE login=$1`
+	_, err := conn.ExecContext(ctx, sqlStatement, login, hashed)
+	return err
+}
+
+// generateSalt returns a random 16-character alphanumeric salt.
+func generateSalt() (string, error) {
+	salt := make([]byte, saltLength)
+	max := big.NewInt(int64(len(saltAlphabet)))
+	for i := range salt {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		salt[i] = saltAlphabet[n.Int64()]
 	}
+	return string(salt), nil
+}
 
-	fmt.Printf("Inserted a single record %v", id)
-	return id
+// hashPassword derives a key from password/salt via scrypt and encodes it
+// as "scrypt:N:r:p$salt$hex(key)" for storage.
+func hashPassword(password string, salt string) (string, error) {
+	derivedKey, err := scrypt.Key([]byte(password), []byte(salt), scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d:%d:%d$%s$%s", scryptPrefix, scryptN, scryptR, scryptP, salt, hex.EncodeToString(derivedKey)), nil
 }
 
-func createSession(user User) string {
-	sessionId := uuid.New().String()
-	sessions[sessionId] = user
-	return sessionId
+// isLegacyPassword reports whether stored is a plaintext password left over
+// from before scrypt hashing was introduced.
+func isLegacyPassword(stored string) bool {
+	return !strings.HasPrefix(stored, scryptPrefix+":")
 }
 
-func createConnection() *sql.DB {
-	psqlconn := os.Getenv("DATABASE_URI")
-	db, err := sql.Open("postgres", psqlconn)
+// verifyPassword checks password against a stored value, transparently
+// supporting the legacy plaintext format alongside "scrypt:..." hashes.
+func verifyPassword(password string, stored string) (bool, error) {
+	if isLegacyPassword(stored) {
+		return password == stored, nil
+	}
+
+	parts := strings.SplitN(stored, "$", 3)
+	if len(parts) != 3 {
+		return false, fmt.Errorf("malformed password hash")
+	}
+
+	params := strings.Split(parts[0], ":")
+	if len(params) != 4 {
+		return false, fmt.Errorf("malformed password hash")
+	}
+
+	n, err := strconv.Atoi(params[1])
+	if err != nil {
+		return false, err
+	}
+	r, err := strconv.Atoi(params[2])
+	if err != nil {
+		return false, err
+	}
+	p, err := strconv.Atoi(params[3])
+	if err != nil {
+		return false, err
+	}
+
+	salt := parts[1]
+	expected, err := hex.DecodeString(parts[2])
 	if err != nil {
-		panic(err)
+		return false, err
 	}
 
-	err = db.Ping()
+	derivedKey, err := scrypt.Key([]byte(password), []byte(salt), n, r, p, len(expected))
 	if err != nil {
-		panic(err)
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(derivedKey, expected) == 1, nil
+}
+
+func insertUser(ctx context.Context, conn *sql.DB, user User) (string, error) {
+	userId := uuid.New().String()
+	sqlStatement := `INSERT INTO users (id, login, password, email, firstName, lastName, role) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING Id`
+
+	var id string
+	if err := conn.QueryRowContext(ctx, sqlStatement, userId, user.Login, user.Password, user.Email, user.FirstName, user.LastName, user.Role).Scan(&id); err != nil {
+		return "", err
 	}
 
-	fmt.Println("Successfully connected!")
-	return db
+	fmt.Printf("Inserted a single record %v", id)
+	return id, nil
+}
+
+func createSession(user User) string {
+	sessionId := uuid.New().String()
+	Sessions.Create(sessionId, toAuthUser(user))
+	return sessionId
 }
@@ -0,0 +1,136 @@
+// Package controllers holds the shared HTTP plumbing used by the user and
+// auth services so individual handlers only have to describe what they do,
+// not how CORS, JSON, errors, and metrics are handled.
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	requestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "json_handler_requests_total",
+		Help: "Total requests handled per route.",
+	}, []string{"route"})
+
+	requestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "json_handler_errors_total",
+		Help: "Total requests that ended in an error per route.",
+	}, []string{"route"})
+
+	requestLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "json_handler_request_duration_seconds",
+		Help: "Request latency per route.",
+	}, []string{"route"})
+)
+
+func init() {
+	prometheus.MustRegister(requestCount, requestErrors, requestLatency)
+}
+
+// JSONResult is what a Process func returns on success: the status code to
+// write and the value to JSON-encode as the body (nil for no body).
+type JSONResult struct {
+	StatusCode int
+	Body       interface{}
+}
+
+// JSONHandler is a reusable http.Handler that decodes a JSON request body
+// into whatever Input() returns, runs Process against it, and encodes the
+// result, taking care of CORS headers, error-to-status mapping, and
+// per-route metrics along the way.
+type JSONHandler struct {
+	// Route names this handler for metrics, e.g. "add_user".
+	Route string
+	// Methods lists the HTTP methods to advertise via CORS headers.
+	Methods []string
+	// Input returns a fresh pointer to decode the request body into. If
+	// Input is nil the body is not read here, and Process gets a nil input
+	// (for routes with no body, or whose Process reads the body itself).
+	Input func() interface{}
+	// Process runs the handler's logic against the decoded input.
+	Process func(writer http.ResponseWriter, request *http.Request, input interface{}, db *sql.DB) (JSONResult, error)
+	// DB is passed through to Process; may be nil if the handler manages
+	// its own connections.
+	DB *sql.DB
+}
+
+func (h *JSONHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	requestStart := time.Now()
+
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	if len(h.Methods) > 0 {
+		writer.Header().Set("Access-Control-Allow-Methods", strings.Join(h.Methods, ", "))
+		writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	}
+
+	var input interface{}
+	if h.Input != nil {
+		input = h.Input()
+		if request.Body != nil && request.ContentLength != 0 {
+			if err := json.NewDecoder(request.Body).Decode(input); err != nil {
+				h.fail(writer, http.StatusBadRequest, "Unable to decode the request body.")
+				return
+			}
+		}
+	}
+
+	result, err := h.Process(writer, request, input, h.DB)
+	if err != nil {
+		var schemaErr *SchemaError
+		if errors.As(err, &schemaErr) {
+			h.failSchema(writer, schemaErr)
+			return
+		}
+
+		status, message := mapError(err)
+		h.fail(writer, status, message)
+		return
+	}
+
+	writer.WriteHeader(result.StatusCode)
+	if result.Body != nil {
+		json.NewEncoder(writer).Encode(result.Body)
+	}
+
+	requestCount.WithLabelValues(h.Route).Inc()
+	requestLatency.WithLabelValues(h.Route).Observe(time.Since(requestStart).Seconds())
+}
+
+func (h *JSONHandler) fail(writer http.ResponseWriter, status int, message string) {
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(map[string]string{"message": message})
+	requestErrors.WithLabelValues(h.Route).Inc()
+}
+
+// failSchema reports a SchemaError's field problems as a structured 400.
+func (h *JSONHandler) failSchema(writer http.ResponseWriter, err *SchemaError) {
+	writer.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"message": "Request body does not match the expected schema.",
+		"fields":  err.Fields,
+	})
+	requestErrors.WithLabelValues(h.Route).Inc()
+}
+
+// mapError maps well-known database errors to HTTP statuses; anything else
+// is a 500.
+func mapError(err error) (int, string) {
+	if errors.Is(err, sql.ErrNoRows) {
+		return http.StatusNotFound, "Not found."
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" {
+		return http.StatusConflict, "Already exists."
+	}
+
+	return http.StatusInternalServerError, err.Error()
+}
@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// FieldError describes a single field-level problem found while validating a
+// request body against a struct's JSON schema.
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// SchemaError lists every field problem found in a request body, so a
+// handler can report missing, unknown, and mismatched fields all at once
+// instead of failing on the first one.
+type SchemaError struct {
+	Fields []FieldError
+}
+
+func (e *SchemaError) Error() string {
+	parts := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		parts[i] = fmt.Sprintf("%s: %s", f.Field, f.Reason)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// DecodeStrict reads request's JSON body into target and validates it
+// against target's json-tagged fields: a tagged field absent from the body
+// and not named in optional is reported missing, a body key with no
+// matching tagged field is reported unknown, a value whose JSON kind
+// doesn't match the field's Go type is reported as a type mismatch, and an
+// explicit null for a field whose Go type has no nil zero value is reported
+// as null rather than silently decoding into the field's zero value. On
+// success it returns the set of field names the body actually supplied, so
+// callers like a partial update can tell what the client sent versus what
+// was merely left at its zero value.
+func DecodeStrict(request *http.Request, target interface{}, optional ...string) (map[string]bool, error) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+
+	fields := schemaFields(target)
+
+	optionalSet := make(map[string]bool, len(optional))
+	for _, name := range optional {
+		optionalSet[name] = true
+	}
+
+	var problems []FieldError
+	present := make(map[string]bool, len(raw))
+
+	for name, field := range fields {
+		value, ok := raw[name]
+		if !ok {
+			if !optionalSet[name] {
+				problems = append(problems, FieldError{Field: name, Reason: "missing"})
+			}
+			continue
+		}
+		present[name] = true
+		if value == nil {
+			if !isNullable(field.Type) {
+				problems = append(problems, FieldError{Field: name, Reason: "null"})
+			}
+			continue
+		}
+		if !kindMatches(field.Type, value) {
+			problems = append(problems, FieldError{Field: name, Reason: "type mismatch"})
+		}
+	}
+
+	for name := range raw {
+		if _, ok := fields[name]; !ok {
+			problems = append(problems, FieldError{Field: name, Reason: "unknown"})
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Slice(problems, func(i, j int) bool { return problems[i].Field < problems[j].Field })
+		return nil, &SchemaError{Fields: problems}
+	}
+
+	if err := json.Unmarshal(body, target); err != nil {
+		return nil, err
+	}
+
+	return present, nil
+}
+
+func schemaFields(target interface{}) map[string]reflect.StructField {
+	t := reflect.TypeOf(target)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+// isNullable reports whether a JSON null is a valid value for a field of
+// type t. Plain value types (string, bool, numbers, structs) have no zero
+// value that means "absent", so null is rejected for them rather than
+// silently decoding into the Go zero value.
+func isNullable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		return true
+	default:
+		return false
+	}
+}
+
+func kindMatches(t reflect.Type, value interface{}) bool {
+	switch t.Kind() {
+	case reflect.String:
+		_, ok := value.(string)
+		return ok
+	case reflect.Bool:
+		_, ok := value.(bool)
+		return ok
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		_, ok := value.(float64)
+		return ok
+	default:
+		return true
+	}
+}
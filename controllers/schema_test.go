@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testUser struct {
+	Id        int64  `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+}
+
+func decodeRequest(t *testing.T, body string, target interface{}, optional ...string) (map[string]bool, error) {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodPost, "/user", strings.NewReader(body))
+	return DecodeStrict(request, target, optional...)
+}
+
+func TestDecodeStrictAcceptsCompleteBody(t *testing.T) {
+	var user testUser
+	present, err := decodeRequest(t, `{"username":"jdoe","firstName":"Jane","lastName":"Doe","email":"jane@example.com","phone":"555-1234"}`, &user, "id")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if user.Username != "jdoe" {
+		t.Fatalf("expected target to be populated, got %+v", user)
+	}
+	for _, field := range []string{"username", "firstName", "lastName", "email", "phone"} {
+		if !present[field] {
+			t.Errorf("expected %q to be reported present", field)
+		}
+	}
+}
+
+func TestDecodeStrictRejectsMissingFields(t *testing.T) {
+	var user testUser
+	_, err := decodeRequest(t, `{"username":"jdoe"}`, &user, "id")
+	if err == nil {
+		t.Fatal("expected an error for a body missing required fields")
+	}
+
+	schemaErr, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatalf("expected a *SchemaError, got %T", err)
+	}
+
+	for _, field := range []string{"firstName", "lastName", "email", "phone"} {
+		if !hasFieldReason(schemaErr, field, "missing") {
+			t.Errorf("expected %q to be reported missing, got %v", field, schemaErr.Fields)
+		}
+	}
+}
+
+func TestDecodeStrictRejectsUnknownFields(t *testing.T) {
+	var user testUser
+	_, err := decodeRequest(t, `{"username":"jdoe","firstName":"Jane","lastName":"Doe","email":"jane@example.com","phone":"555-1234","nickname":"jd"}`, &user, "id")
+	if err == nil {
+		t.Fatal("expected an error for a body with an unknown field")
+	}
+
+	schemaErr, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatalf("expected a *SchemaError, got %T", err)
+	}
+
+	if !hasFieldReason(schemaErr, "nickname", "unknown") {
+		t.Errorf("expected %q to be reported unknown, got %v", "nickname", schemaErr.Fields)
+	}
+}
+
+func TestDecodeStrictRejectsTypeMismatch(t *testing.T) {
+	var user testUser
+	_, err := decodeRequest(t, `{"username":123,"firstName":"Jane","lastName":"Doe","email":"jane@example.com","phone":"555-1234"}`, &user, "id")
+	if err == nil {
+		t.Fatal("expected an error for a body with a type mismatch")
+	}
+
+	schemaErr, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatalf("expected a *SchemaError, got %T", err)
+	}
+
+	if !hasFieldReason(schemaErr, "username", "type mismatch") {
+		t.Errorf("expected %q to be reported as a type mismatch, got %v", "username", schemaErr.Fields)
+	}
+}
+
+func TestDecodeStrictAllowsOptionalFieldsForPartialUpdate(t *testing.T) {
+	var user testUser
+	present, err := decodeRequest(t, `{"email":"jane@example.com"}`, &user, "id", "username", "firstName", "lastName", "phone")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !present["email"] {
+		t.Error("expected email to be reported present")
+	}
+	if present["phone"] {
+		t.Error("did not expect phone to be reported present")
+	}
+}
+
+func TestDecodeStrictRejectsNullForNonNullableField(t *testing.T) {
+	var user testUser
+	_, err := decodeRequest(t, `{"email":null}`, &user, "id", "username", "firstName", "lastName", "phone")
+	if err == nil {
+		t.Fatal("expected an error for a body with a null non-nullable field")
+	}
+
+	schemaErr, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatalf("expected a *SchemaError, got %T", err)
+	}
+
+	if !hasFieldReason(schemaErr, "email", "null") {
+		t.Errorf("expected %q to be reported null, got %v", "email", schemaErr.Fields)
+	}
+}
+
+func hasFieldReason(err *SchemaError, field, reason string) bool {
+	for _, f := range err.Fields {
+		if f.Field == field && f.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
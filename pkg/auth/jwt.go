@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Claims is the JWT payload issued on login: the registered claims carry
+// sub/iat/exp/jti, the rest is what handlers need without a DB round-trip.
+type Claims struct {
+	jwt.RegisteredClaims
+	Login string `json:"login"`
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+// RevocationChecker reports whether a token's JTI has been revoked, e.g. via
+// logout. Implementations typically back this with a DB table.
+type RevocationChecker interface {
+	IsRevoked(jti string) (bool, error)
+}
+
+var (
+	jwtSecretOnce  sync.Once
+	jwtSecretValue []byte
+	jwtSecretErr   error
+)
+
+// JWTSecret returns the HMAC signing key configured via JWT_SECRET or
+// JWT_SECRET_FILE, reading it only once. Callers that sign or verify tokens
+// must treat a non-nil error as fatal: signing with no configured secret
+// would sign with an empty key, which anyone can forge. main should call
+// this at startup (alongside db.Open) so a missing secret fails fast
+// instead of shipping forgeable tokens.
+func JWTSecret() ([]byte, error) {
+	jwtSecretOnce.Do(func() {
+		if secret := os.Getenv("JWT_SECRET"); secret != "" {
+			jwtSecretValue = []byte(secret)
+			return
+		}
+		if path := os.Getenv("JWT_SECRET_FILE"); path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				jwtSecretErr = fmt.Errorf("reading JWT_SECRET_FILE: %w", err)
+				return
+			}
+			jwtSecretValue = data
+			return
+		}
+		jwtSecretErr = errors.New("no JWT signing secret configured: set JWT_SECRET or JWT_SECRET_FILE")
+	})
+	return jwtSecretValue, jwtSecretErr
+}
+
+// IssueToken signs an HS256 JWT for user that expires after ttl, with a
+// random JTI so it can be individually revoked later.
+func IssueToken(user User, ttl time.Duration) (string, error) {
+	secret, err := JWTSecret()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   user.Id,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			ID:        uuid.New().String(),
+		},
+		Login: user.Login,
+		Email: user.Email,
+		Role:  user.Role,
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+}
+
+// ParseToken verifies the signature and expiry of tokenString and returns
+// its claims.
+func ParseToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return JWTSecret()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+// JWTMiddleware parses "Authorization: Bearer <token>", verifies the
+// signature and expiry, checks revoked (skipped if nil) for the token's JTI,
+// and requires at least one of roles (any valid token if roles is empty)
+// before injecting the resolved user into the request context.
+func JWTMiddleware(revoked RevocationChecker, roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			tokenString := bearerToken(request)
+			if tokenString == "" {
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			claims, err := ParseToken(tokenString)
+			if err != nil {
+				writer.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			if revoked != nil {
+				isRevoked, err := revoked.IsRevoked(claims.ID)
+				if err != nil || isRevoked {
+					writer.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+			}
+
+			if len(roles) > 0 && !hasRole(claims.Role, roles) {
+				writer.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			user := User{Id: claims.Subject, Login: claims.Login, Email: claims.Email, Role: claims.Role}
+			next.ServeHTTP(writer, request.WithContext(WithUser(request.Context(), user)))
+		})
+	}
+}
+
+func bearerToken(request *http.Request) string {
+	header := request.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(header, "Bearer ")
+}
+
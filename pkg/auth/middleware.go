@@ -0,0 +1,29 @@
+package auth
+
+import (
+	"context"
+)
+
+type contextKey string
+
+const userContextKey contextKey = "auth.user"
+
+// WithUser returns a copy of ctx carrying user.
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, userContextKey, user)
+}
+
+// UserFromContext returns the user injected by JWTMiddleware, if any.
+func UserFromContext(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userContextKey).(User)
+	return user, ok
+}
+
+func hasRole(role string, allowed []string) bool {
+	for _, a := range allowed {
+		if role == a {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+// Package auth provides session and access-control primitives shared by the
+// user and auth services.
+package auth
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// User is the subset of user data that gets attached to a session.
+type User struct {
+	Id        string
+	Login     string
+	Password  string
+	Email     string
+	FirstName string
+	LastName  string
+	Role      string
+}
+
+// Session is a single logged-in session, keyed by its session ID.
+type Session struct {
+	Id         string
+	User       User
+	LastAccess time.Time
+}
+
+const evictInterval = time.Minute
+
+// SessionStore holds sessions in memory, evicting ones idle longer than TTL
+// and allowing the whole set to be snapshotted to/reloaded from disk.
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	ttl      time.Duration
+	stop     chan struct{}
+}
+
+// NewSessionStore creates a SessionStore that evicts sessions idle longer
+// than ttl and starts the background eviction goroutine.
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	store := &SessionStore{
+		sessions: make(map[string]*Session),
+		ttl:      ttl,
+		stop:     make(chan struct{}),
+	}
+	go store.evictLoop()
+	return store
+}
+
+// Create starts a new session for user under sessionId.
+func (s *SessionStore) Create(sessionId string, user User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sessionId] = &Session{Id: sessionId, User: user, LastAccess: time.Now()}
+}
+
+// Lookup returns the user for sessionId and bumps its last-access time.
+func (s *SessionStore) Lookup(sessionId string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[sessionId]
+	if !ok {
+		return User{}, false
+	}
+	session.LastAccess = time.Now()
+	return session.User, true
+}
+
+// Refresh bumps the last-access time for sessionId without returning it.
+func (s *SessionStore) Refresh(sessionId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[sessionId]; ok {
+		session.LastAccess = time.Now()
+	}
+}
+
+// Delete removes sessionId, e.g. on logout.
+func (s *SessionStore) Delete(sessionId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sessionId)
+}
+
+// Close stops the background eviction goroutine.
+func (s *SessionStore) Close() {
+	close(s.stop)
+}
+
+func (s *SessionStore) evictLoop() {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.evictExpired()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *SessionStore) evictExpired() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, session := range s.sessions {
+		if now.Sub(session.LastAccess) > s.ttl {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// Snapshot writes every session to w so the store can be restored later.
+func (s *SessionStore) Snapshot(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(len(s.sessions)))
+	if _, err := w.Write(count[:]); err != nil {
+		return err
+	}
+	for _, session := range s.sessions {
+		if err := session.serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load reads sessions previously written by Snapshot, merging them into the
+// store. An empty r is treated as an empty snapshot.
+func (s *SessionStore) Load(r io.Reader) error {
+	var count [4]byte
+	if _, err := io.ReadFull(r, count[:]); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := binary.BigEndian.Uint32(count[:])
+	for i := uint32(0); i < n; i++ {
+		session, err := deserializeSession(r)
+		if err != nil {
+			return err
+		}
+		s.sessions[session.Id] = session
+	}
+	return nil
+}
+
+func writeField(w io.Writer, b []byte) error {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(b)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readField(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// serialize writes the session as a sequence of length-prefixed fields:
+// session ID, user fields, then the last-access timestamp via MarshalText.
+func (s *Session) serialize(w io.Writer) error {
+	lastAccess, err := s.LastAccess.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	fields := [][]byte{
+		[]byte(s.Id),
+		[]byte(s.User.Id),
+		[]byte(s.User.Login),
+		[]byte(s.User.Password),
+		[]byte(s.User.Email),
+		[]byte(s.User.FirstName),
+		[]byte(s.User.LastName),
+		[]byte(s.User.Role),
+		lastAccess,
+	}
+	for _, field := range fields {
+		if err := writeField(w, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deserializeSession reads a session written by Session.serialize.
+func deserializeSession(r io.Reader) (*Session, error) {
+	fields := make([][]byte, 9)
+	for i := range fields {
+		field, err := readField(r)
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = field
+	}
+
+	var lastAccess time.Time
+	if err := lastAccess.UnmarshalText(fields[8]); err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		Id: string(fields[0]),
+		User: User{
+			Id:        string(fields[1]),
+			Login:     string(fields[2]),
+			Password:  string(fields[3]),
+			Email:     string(fields[4]),
+			FirstName: string(fields[5]),
+			LastName:  string(fields[6]),
+			Role:      string(fields[7]),
+		},
+		LastAccess: lastAccess,
+	}, nil
+}
@@ -0,0 +1,70 @@
+// Package db owns the process-wide *sql.DB pool shared by every handler, in
+// place of opening a fresh connection per request.
+package db
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMaxOpenConns    = 16
+	defaultMaxIdleConns    = 8
+	defaultConnMaxIdleTime = 5 * time.Minute
+)
+
+var openConnections = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "db_open_connections",
+	Help: "Number of established connections to the database, both in use and idle.",
+}, func() float64 {
+	if pool == nil {
+		return 0
+	}
+	return float64(pool.Stats().OpenConnections)
+})
+
+func init() {
+	prometheus.MustRegister(openConnections)
+}
+
+var pool *sql.DB
+
+// Open opens the singleton connection pool against DATABASE_URI, tuning it
+// from DB_MAX_OPEN_CONNS/DB_MAX_IDLE_CONNS/DB_CONN_MAX_IDLE_TIME (falling
+// back to 16/8/5m). Callers should hold onto the returned *sql.DB and use it
+// for the life of the process; it must not be closed per-request.
+func Open() (*sql.DB, error) {
+	db, err := sql.Open("postgres", os.Getenv("DATABASE_URI"))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(envInt("DB_MAX_OPEN_CONNS", defaultMaxOpenConns))
+	db.SetMaxIdleConns(envInt("DB_MAX_IDLE_CONNS", defaultMaxIdleConns))
+	db.SetConnMaxIdleTime(envDuration("DB_CONN_MAX_IDLE_TIME", defaultConnMaxIdleTime))
+
+	pool = db
+	return pool, nil
+}
+
+func envInt(name string, fallback int) int {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return value
+	}
+	return fallback
+}